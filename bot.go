@@ -1,34 +1,157 @@
 package bot
 
 import (
-	"github.com/sorcix/irc"
+	"errors"
+	"math/rand"
+	"net"
 	"sync"
 	"time"
+
+	"github.com/sorcix/irc"
 )
 
 const (
-	floodTime = time.Millisecond * 500 // Pause between outgoing messages
-	pingTime  = time.Minute            // Time between pings
+	defaultBurst  = 1                      // Default value for Client.RateLimit's burst
+	defaultPeriod = time.Millisecond * 500 // Default value for Client.RateLimit's per
+
+	defaultTimeout  = time.Minute // Default value for Client.Timeout
+	defaultPingFreq = time.Minute // Default value for Client.PingFreq
+
+	backoffMin = time.Second // Initial delay before the first reconnect attempt
+	backoffMax = time.Minute // Upper bound on the reconnect delay
 )
 
+// Dialer establishes a new Transport to the IRC server. NewClientDialer
+// calls it once to connect, and Loop calls it again every time the
+// connection needs to be re-established.
+type Dialer func() (Transport, error)
+
+// session groups the state tied to a single underlying connection, so
+// it can be swapped out wholesale on reconnect without racing the
+// goroutines still shutting down the previous one.
+type session struct {
+	transport Transport
+	quit      chan struct{}
+	quitOnce  sync.Once
+
+	mu          sync.Mutex
+	lastMessage time.Time
+
+	capMu      sync.Mutex
+	capWanted  map[string]bool
+	capEnabled map[string]bool
+	capMechs   []string
+	capLSBuf   []string // entries accumulated across a multiline CAP LS
+	capTimer   *time.Timer
+	capEndOnce sync.Once
+}
+
+// newSession wraps t into a fresh session ready to be handed to
+// Client.start.
+func newSession(t Transport) *session {
+	return &session{
+		transport:  t,
+		quit:       make(chan struct{}),
+		capWanted:  make(map[string]bool),
+		capEnabled: make(map[string]bool),
+	}
+}
+
+// touch records that a message was just seen on this session.
+func (s *session) touch() {
+	s.mu.Lock()
+	s.lastMessage = time.Now()
+	s.mu.Unlock()
+}
+
+// idle returns how long it has been since the last message was seen.
+func (s *session) idle() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastMessage)
+}
+
+// close stops the goroutines bound to this session and closes its
+// connection. It is safe to call more than once.
+func (s *session) close() {
+	s.quitOnce.Do(func() {
+		close(s.quit)
+	})
+	s.capMu.Lock()
+	if s.capTimer != nil {
+		s.capTimer.Stop()
+	}
+	s.capMu.Unlock()
+	s.transport.Close()
+}
+
 // The Client type provides a barebones IRC client.
 type Client struct {
-	server *irc.Conn
+	dial Dialer
 
-	quit  chan struct{}
-	queue chan *irc.Message
+	// priority carries messages that bypass the rate limiter and any
+	// per-target queueing, namely PONG and QUIT.
+	priority chan *irc.Message
+
+	sendMu  sync.Mutex
+	targets map[string]chan *irc.Message
+	pending map[string]int
+	order   []string
+	sched   int
+	ready   chan struct{}
+
+	tokens     chan struct{}
+	stopRefill chan struct{}
 
 	handler func(*irc.Message, irc.Sender)
 
-	quitOnce sync.Once
+	// OnConnect, if set, is called when Loop starts and after every
+	// successful reconnection, right after Identify's messages have been
+	// queued; it does not wait for the server to confirm registration.
+	// It is the place to join channels or authenticate with NickServ.
+	OnConnect func(*Client)
+
+	nickname, username, realname string
+
+	// Timeout is how long to wait for a message, including a PONG,
+	// before the connection is considered dead. Set via NewClient or
+	// NewClientDialer; changing it afterwards races with the running
+	// ping and input goroutines.
+	Timeout time.Duration
+
+	// PingFreq is how often to ping the server to detect a stale
+	// connection. Set via NewClient or NewClientDialer; changing it
+	// afterwards races with the running ping goroutine.
+	PingFreq time.Duration
+
+	// SASLLogin and SASLPassword configure SASL authentication,
+	// performed during IRCv3 capability negotiation before registration
+	// completes. SASLMech selects the mechanism ("PLAIN" or "EXTERNAL")
+	// and defaults to "PLAIN".
+	SASLLogin, SASLPassword, SASLMech string
+
+	requestedCaps []string
+
+	mu    sync.Mutex
+	cur   *session
+	tries int
+
+	done     chan struct{}
+	doneOnce sync.Once
 
 	wg sync.WaitGroup
 }
 
 // NewClient returns a client that communicates over conn.
 //
-// Incoming messages are sent to the handler func.
-func NewClient(conn *irc.Conn, handler func(*irc.Message, irc.Sender)) *Client {
+// Incoming messages are sent to the handler func. Pass a *Router's
+// Dispatch method as handler to use per-command callbacks instead of a
+// single switch. timeout and pingFreq set Client.Timeout and
+// Client.PingFreq; pass 0 for either to use the one-minute default.
+// A client created this way has no Dialer and therefore cannot
+// reconnect: Loop simply waits for it to disconnect. Use
+// NewClientDialer for auto-reconnect.
+func NewClient(conn net.Conn, handler func(*irc.Message, irc.Sender), timeout, pingFreq time.Duration) *Client {
 
 	if conn == nil || handler == nil {
 		// An IRC client is useless without a connection or a handler.
@@ -36,71 +159,256 @@ func NewClient(conn *irc.Conn, handler func(*irc.Message, irc.Sender)) *Client {
 	}
 
 	c := new(Client)
-	c.quit = make(chan struct{})
-	c.queue = make(chan *irc.Message, 100)
+	c.initQueues()
+	c.handler = handler
+	c.done = make(chan struct{})
+	c.Timeout = orDefault(timeout, defaultTimeout)
+	c.PingFreq = orDefault(pingFreq, defaultPingFreq)
+	c.RateLimit(defaultBurst, defaultPeriod)
+
+	c.start(newSession(NewIRCTransport(conn)))
+
+	return c
+}
 
+// NewClientDialer returns a client that connects through dial, and
+// reconnects through it whenever the connection is lost. timeout and
+// pingFreq set Client.Timeout and Client.PingFreq; pass 0 for either
+// to use the one-minute default. Call Loop to drive the reconnect
+// cycle.
+func NewClientDialer(dial Dialer, handler func(*irc.Message, irc.Sender), timeout, pingFreq time.Duration) (*Client, error) {
+
+	if dial == nil || handler == nil {
+		return nil, errors.New("bot: dial and handler must not be nil")
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(Client)
+	c.dial = dial
+	c.initQueues()
 	c.handler = handler
-	c.server = conn
+	c.done = make(chan struct{})
+	c.Timeout = orDefault(timeout, defaultTimeout)
+	c.PingFreq = orDefault(pingFreq, defaultPingFreq)
+	c.RateLimit(defaultBurst, defaultPeriod)
 
-	c.wg.Add(3)
+	c.start(newSession(conn))
 
-	go c.input()
-	go c.output()
-	go c.ping()
+	return c, nil
+}
 
-	return c
+// orDefault returns d, or def if d is zero or negative.
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// start wires up a session's goroutines and makes it the client's
+// current one.
+func (c *Client) start(s *session) {
+	c.mu.Lock()
+	c.cur = s
+	c.mu.Unlock()
+
+	c.wg.Add(3)
+	go c.input(s)
+	go c.output(s)
+	go c.ping(s)
+}
+
+// session returns the client's current session.
+func (c *Client) session() *session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cur
 }
 
 // Identify sends both USER and NICK messages to the server.
 //
 // On servers without a password, this should be the first thing to do!
+// The nickname, username and realname are remembered so Loop can
+// re-identify automatically after a reconnect.
 func (c *Client) Identify(nickname, username, realname string) {
+	c.nickname, c.username, c.realname = nickname, username, realname
+	c.identify()
+}
+
+func (c *Client) identify() {
+	c.negotiateCaps()
 	c.Send(&irc.Message{
 		Command:  irc.USER,
-		Params:   []string{username, "0", "*"},
-		Trailing: realname,
+		Params:   []string{c.username, "0", "*"},
+		Trailing: c.realname,
 	})
 	c.Send(&irc.Message{
 		Command: irc.NICK,
-		Params:  []string{nickname},
+		Params:  []string{c.nickname},
 	})
 }
 
+// RequestCaps adds IRCv3 capabilities to request during CAP
+// negotiation, on top of "sasl" when SASL is configured. Call it
+// before Identify.
+func (c *Client) RequestCaps(caps []string) {
+	c.requestedCaps = append(c.requestedCaps, caps...)
+}
+
+// EnabledCaps returns the IRCv3 capabilities the server acknowledged
+// for the current connection.
+func (c *Client) EnabledCaps() []string {
+	s := c.session()
+	s.capMu.Lock()
+	defer s.capMu.Unlock()
+
+	caps := make([]string, 0, len(s.capEnabled))
+	for name := range s.capEnabled {
+		caps = append(caps, name)
+	}
+	return caps
+}
+
+// SASLMechs returns the SASL mechanisms the server advertised.
+func (c *Client) SASLMechs() []string {
+	s := c.session()
+	s.capMu.Lock()
+	defer s.capMu.Unlock()
+	return append([]string(nil), s.capMechs...)
+}
+
 // Sends queues a message for sending.
 //
-// Messages are queued to prevent flooding.
+// Messages are rate-limited to prevent flooding, and fairly scheduled
+// across per-target queues so one busy channel can't starve the rest.
+// PONG and QUIT are the exception: they bypass all of that and go out
+// as soon as possible.
 func (c *Client) Send(m *irc.Message) error {
-	c.queue <- m
+	if m.Command == irc.PONG || m.Command == irc.QUIT {
+		c.priority <- m
+		return nil
+	}
+	c.enqueue(m)
 	return nil
 }
 
-// Disconnect stops all goroutines and closes the underlying connection.
+// Disconnect closes the current connection and stops its goroutines.
+//
+// If the client was created with a Dialer, Loop will reconnect; to stop
+// for good, call Quit instead.
 func (c *Client) Disconnect() {
-	c.server.Close()
-	c.quitOnce.Do(func() {
-		close(c.quit)
+	c.session().close()
+}
+
+// Quit disconnects and stops Loop from reconnecting.
+func (c *Client) Quit() {
+	c.doneOnce.Do(func() {
+		close(c.done)
 	})
+	c.Disconnect()
 }
 
-// Wait blocks until the client exited.
+// Wait blocks until the current connection's goroutines exited.
 func (c *Client) Wait() {
 	c.wg.Wait()
 }
 
-// ping keeps the connection alive by sending a ping every minute.
-func (c *Client) ping() {
+// Loop blocks until Quit is called, or, for a client without a Dialer,
+// until its connection closes.
+//
+// If the client has a Dialer, Loop reconnects automatically after a
+// disconnect, with an exponential, jittered backoff, re-running
+// Identify and OnConnect each time. Without a Dialer it simply waits
+// for the connection to close.
+func (c *Client) Loop() {
+	if c.OnConnect != nil {
+		c.OnConnect(c)
+	}
+
+	for {
+		c.wg.Wait()
+
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		if c.dial == nil {
+			return
+		}
+
+		c.reconnect()
+	}
+}
+
+// reconnect redials with an exponential, jittered backoff until it
+// succeeds or Quit is called.
+func (c *Client) reconnect() {
+	delay := backoffMin
+	for {
+		timer := time.NewTimer(jitter(delay))
+		select {
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		conn, err := c.dial()
+		if err != nil {
+			c.tries++
+			if delay *= 2; delay > backoffMax {
+				delay = backoffMax
+			}
+			continue
+		}
+
+		c.tries = 0
+		c.start(newSession(conn))
+
+		if c.nickname != "" {
+			c.identify()
+		}
+		if c.OnConnect != nil {
+			c.OnConnect(c)
+		}
+		return
+	}
+}
+
+// jitter returns d plus up to 50% random jitter, so that many clients
+// dropped by the same event don't all redial in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// ping keeps the connection alive by pinging it periodically, and
+// forces a disconnect if nothing — not even a PONG — was heard for
+// longer than Timeout.
+func (c *Client) ping(s *session) {
 
 	defer c.wg.Done()
 
-	ticker := time.NewTicker(pingTime)
+	s.touch()
+
+	ticker := time.NewTicker(c.PingFreq)
 	for {
 		select {
 
-		case <-c.quit:
+		case <-s.quit:
 			ticker.Stop()
 			return
 
 		case <-ticker.C:
+			if s.idle() > c.Timeout {
+				s.close()
+				return
+			}
 			c.Send(&irc.Message{
 				Command:  irc.PING,
 				Trailing: time.Now().Format(time.RFC3339Nano),
@@ -110,7 +418,11 @@ func (c *Client) ping() {
 }
 
 // input reads messages from the server and passes them to the handler.
-func (c *Client) input() {
+//
+// Each read is bounded by a deadline so a connection that the OS never
+// reports as closed (a dead NAT, a silently dropped cable) is still
+// noticed promptly.
+func (c *Client) input(s *session) {
 	var (
 		m   *irc.Message
 		err error
@@ -118,35 +430,33 @@ func (c *Client) input() {
 	defer c.wg.Done()
 	for {
 		select {
-		case <-c.quit:
+		case <-s.quit:
 			return
 		default:
-			if m, err = c.server.Decoder.Decode(); err != nil {
-				c.Disconnect()
+			s.transport.SetReadDeadline(time.Now().Add(c.Timeout + c.PingFreq))
+			if m, err = s.transport.ReadMessage(); err != nil {
+				s.close()
 				return
 			}
+			s.touch()
+			c.handleCapNegotiation(s, m)
 			go c.handler(m, c)
 		}
 	}
 }
 
-// output consumes messages from the sending queue and sends them to the server.
-func (c *Client) output() {
-	var (
-		m   *irc.Message
-		err error
-	)
+// output sends queued messages to the server as the rate limiter and
+// per-target scheduling let them through.
+func (c *Client) output(s *session) {
 	defer c.wg.Done()
 	for {
-		select {
-		case <-c.quit:
+		m, ok := c.next(s)
+		if !ok {
+			return
+		}
+		if err := s.transport.WriteMessage(m); err != nil {
+			s.close()
 			return
-		case m = <-c.queue:
-			if err = c.server.Encoder.Encode(m); err != nil {
-				c.Disconnect()
-				return
-			}
-			time.Sleep(floodTime)
 		}
 	}
 }
@@ -0,0 +1,197 @@
+package bot
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// authenticate is the IRCv3 AUTHENTICATE command, which irc doesn't
+// define a constant for.
+const authenticate = "AUTHENTICATE"
+
+// saslChunkSize is the maximum length of a base64-encoded AUTHENTICATE
+// line, per the IRCv3 SASL specification.
+const saslChunkSize = 400
+
+// negotiateCaps kicks off IRCv3 capability negotiation by sending
+// CAP LS. It is a no-op if nothing has been requested, so bots that
+// don't care about caps or SASL never block on them. A timer bounded
+// by Timeout guarantees CAP END is eventually sent even if the server
+// never replies, so registration can't stall forever.
+func (c *Client) negotiateCaps() {
+	if len(c.requestedCaps) == 0 && c.SASLLogin == "" {
+		return
+	}
+
+	s := c.session()
+
+	s.capMu.Lock()
+	for _, name := range c.requestedCaps {
+		s.capWanted[name] = true
+	}
+	if c.SASLLogin != "" {
+		s.capWanted["sasl"] = true
+	}
+	s.capTimer = time.AfterFunc(c.Timeout, func() { c.endCaps(s) })
+	s.capMu.Unlock()
+
+	c.Send(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"LS", "302"},
+	})
+}
+
+// handleCapNegotiation intercepts the messages that drive CAP and SASL
+// negotiation. It never consumes a message: everything still reaches
+// the client's regular handler afterwards.
+func (c *Client) handleCapNegotiation(s *session, m *irc.Message) {
+	switch m.Command {
+	case "CAP":
+		c.handleCap(s, m)
+	case authenticate:
+		c.handleAuthenticate(s, m)
+	case "903", "904", "905", "906", "907", "908": // SASL success/fail/too-long/aborted/already/mechs
+		c.endCaps(s)
+	}
+}
+
+func (c *Client) handleCap(s *session, m *irc.Message) {
+	if len(m.Params) < 2 {
+		return
+	}
+
+	switch m.Params[1] {
+	case "LS":
+		// A "*" before the trailing list marks a continuation: more
+		// LS lines follow, and the cap list isn't complete until one
+		// arrives without it.
+		continuation := len(m.Params) > 2 && m.Params[2] == "*"
+
+		s.capMu.Lock()
+		s.capLSBuf = append(s.capLSBuf, strings.Fields(m.Trailing)...)
+		if continuation {
+			s.capMu.Unlock()
+			return
+		}
+		entries := s.capLSBuf
+		s.capLSBuf = nil
+
+		var requested []string
+		for _, entry := range entries {
+			name := entry
+			if i := strings.IndexByte(entry, '='); i >= 0 {
+				name = entry[:i]
+				if name == "sasl" {
+					s.capMechs = strings.Split(entry[i+1:], ",")
+				}
+			}
+			if s.capWanted[name] {
+				requested = append(requested, name)
+			}
+		}
+		s.capMu.Unlock()
+
+		if len(requested) == 0 {
+			c.endCaps(s)
+			return
+		}
+		c.Send(&irc.Message{
+			Command:  "CAP",
+			Params:   []string{"REQ"},
+			Trailing: strings.Join(requested, " "),
+		})
+
+	case "ACK":
+		names := strings.Fields(m.Trailing)
+
+		s.capMu.Lock()
+		sasl := false
+		for _, name := range names {
+			s.capEnabled[name] = true
+			delete(s.capWanted, name)
+			if name == "sasl" {
+				sasl = true
+			}
+		}
+		s.capMu.Unlock()
+
+		if sasl && c.SASLLogin != "" {
+			mech := c.SASLMech
+			if mech == "" {
+				mech = "PLAIN"
+			}
+			c.Send(&irc.Message{Command: authenticate, Params: []string{mech}})
+			return
+		}
+		c.endCaps(s)
+
+	case "NAK":
+		s.capMu.Lock()
+		for _, name := range strings.Fields(m.Trailing) {
+			delete(s.capWanted, name)
+		}
+		s.capMu.Unlock()
+		c.endCaps(s)
+	}
+}
+
+func (c *Client) handleAuthenticate(s *session, m *irc.Message) {
+	if len(m.Params) == 0 || m.Params[0] != "+" {
+		return
+	}
+
+	mech := c.SASLMech
+	if mech == "" {
+		mech = "PLAIN"
+	}
+
+	if mech == "EXTERNAL" {
+		c.sendSASLPayload(nil)
+		return
+	}
+	c.sendSASLPayload([]byte(c.SASLLogin + "\x00" + c.SASLLogin + "\x00" + c.SASLPassword))
+}
+
+// sendSASLPayload base64-encodes payload and sends it as one or more
+// AUTHENTICATE lines, each at most saslChunkSize bytes. Per the IRCv3
+// SASL specification, a trailing empty "+" line follows whenever the
+// payload is empty or its last chunk is exactly saslChunkSize bytes,
+// so the server can tell "more data follows" from "done".
+func (c *Client) sendSASLPayload(payload []byte) {
+	encoded := base64.StdEncoding.EncodeToString(payload)
+
+	for len(encoded) >= saslChunkSize {
+		c.Send(&irc.Message{Command: authenticate, Params: []string{encoded[:saslChunkSize]}})
+		encoded = encoded[saslChunkSize:]
+	}
+
+	if encoded != "" {
+		c.Send(&irc.Message{Command: authenticate, Params: []string{encoded}})
+		return
+	}
+	c.Send(&irc.Message{Command: authenticate, Params: []string{"+"}})
+}
+
+// endCaps sends CAP END, unblocking registration. It is safe to call
+// more than once per session. s must still be the client's current
+// session: Send has no notion of which session a message belongs to,
+// so acting on behalf of a session that was since replaced (e.g. a
+// capTimer that fired after a reconnect) would inject CAP END into
+// the new session's unrelated negotiation.
+func (c *Client) endCaps(s *session) {
+	if s != c.session() {
+		return
+	}
+	s.capEndOnce.Do(func() {
+		s.capMu.Lock()
+		if s.capTimer != nil {
+			s.capTimer.Stop()
+		}
+		s.capMu.Unlock()
+
+		c.Send(&irc.Message{Command: "CAP", Params: []string{"END"}})
+	})
+}
@@ -0,0 +1,97 @@
+package bot
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// sentAuthLines drains the AUTHENTICATE lines sendSASLPayload queued
+// on c, in the order they were sent.
+func sentAuthLines(t *testing.T, c *Client) []string {
+	t.Helper()
+	var lines []string
+	for {
+		m, ok := c.dequeue()
+		if !ok {
+			return lines
+		}
+		if m.Command != authenticate {
+			t.Fatalf("queued message has command %q, want %q", m.Command, authenticate)
+		}
+		lines = append(lines, m.Params[0])
+	}
+}
+
+func TestSendSASLPayloadChunking(t *testing.T) {
+	tests := []struct {
+		name      string
+		payload   []byte
+		wantLines []string
+	}{
+		{
+			name:      "empty payload",
+			payload:   nil,
+			wantLines: []string{"+"},
+		},
+		{
+			name:      "short payload, single line",
+			payload:   []byte("alice\x00alice\x00hunter2"),
+			wantLines: []string{base64.StdEncoding.EncodeToString([]byte("alice\x00alice\x00hunter2"))},
+		},
+		{
+			name:      "encodes to exactly saslChunkSize, needs trailing +",
+			payload:   make([]byte, saslChunkSize/4*3), // base64 expands 3 bytes -> 4 chars
+			wantLines: nil,                              // filled in below
+		},
+		{
+			name:      "encodes to one base64 group over saslChunkSize",
+			payload:   make([]byte, saslChunkSize/4*3+3),
+			wantLines: nil, // filled in below
+		},
+	}
+
+	for i := range tests {
+		encoded := base64.StdEncoding.EncodeToString(tests[i].payload)
+		switch tests[i].name {
+		case "encodes to exactly saslChunkSize, needs trailing +":
+			if len(encoded) != saslChunkSize {
+				t.Fatalf("test setup: encoded payload is %d bytes, want exactly %d", len(encoded), saslChunkSize)
+			}
+			tests[i].wantLines = []string{encoded, "+"}
+		case "encodes to one base64 group over saslChunkSize":
+			if len(encoded) <= saslChunkSize {
+				t.Fatalf("test setup: encoded payload is %d bytes, want more than %d", len(encoded), saslChunkSize)
+			}
+			tests[i].wantLines = []string{encoded[:saslChunkSize], encoded[saslChunkSize:]}
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient()
+			c.sendSASLPayload(tt.payload)
+
+			got := sentAuthLines(t, c)
+			if len(got) != len(tt.wantLines) {
+				t.Fatalf("sent %d AUTHENTICATE lines (%v), want %d (%v)", len(got), got, len(tt.wantLines), tt.wantLines)
+			}
+			for i, want := range tt.wantLines {
+				if got[i] != want {
+					t.Errorf("line %d = %q, want %q", i, got[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestSendSASLPayloadNeverExceedsChunkSize(t *testing.T) {
+	c := newTestClient()
+	c.sendSASLPayload([]byte(strings.Repeat("this is not a realistic password but it needs to be long enough to span several AUTHENTICATE chunks once base64 encoded, so here is some filler text to get there", 5)))
+
+	for _, line := range sentAuthLines(t, c) {
+		if len(line) > saslChunkSize {
+			t.Errorf("AUTHENTICATE line is %d bytes, want at most %d", len(line), saslChunkSize)
+		}
+	}
+}
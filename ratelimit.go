@@ -0,0 +1,174 @@
+package bot
+
+import (
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// initQueues sets up the structures behind Send: the priority bypass
+// channel and the (initially empty) set of per-target queues.
+func (c *Client) initQueues() {
+	c.priority = make(chan *irc.Message, 10)
+	c.targets = make(map[string]chan *irc.Message)
+	c.pending = make(map[string]int)
+	c.ready = make(chan struct{}, 1)
+}
+
+// RateLimit configures the token-bucket limiter applied to queued
+// messages: up to burst messages may go out back-to-back, after which
+// sends are throttled to one every per. Pass burst 0 to disable rate
+// limiting entirely.
+func (c *Client) RateLimit(burst int, per time.Duration) {
+	c.sendMu.Lock()
+	if c.stopRefill != nil {
+		close(c.stopRefill)
+	}
+
+	if burst <= 0 {
+		c.tokens = nil
+		c.stopRefill = nil
+		c.sendMu.Unlock()
+		return
+	}
+
+	tokens := make(chan struct{}, burst)
+	for i := 0; i < burst; i++ {
+		tokens <- struct{}{}
+	}
+	stop := make(chan struct{})
+	c.tokens = tokens
+	c.stopRefill = stop
+	c.sendMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(per)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				select {
+				case tokens <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+}
+
+// enqueue appends m to the queue for its target, creating one if this
+// is the first message seen for it (or if its previous queue was
+// since evicted). The target is m's first param, whatever the command
+// (for USER, NICK or CAP that is not a channel or nick to talk to);
+// messages with no params at all, such as PING, share a single queue
+// keyed by "". pending tracks the send that is
+// about to happen so dequeue doesn't evict the target queue out from
+// under it.
+func (c *Client) enqueue(m *irc.Message) {
+	key := ""
+	if len(m.Params) > 0 {
+		key = m.Params[0]
+	}
+
+	c.sendMu.Lock()
+	q, ok := c.targets[key]
+	if !ok {
+		q = make(chan *irc.Message, 100)
+		c.targets[key] = q
+		c.order = append(c.order, key)
+	}
+	c.pending[key]++
+	c.sendMu.Unlock()
+
+	q <- m
+
+	c.sendMu.Lock()
+	c.pending[key]--
+	c.sendMu.Unlock()
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// dequeue picks the next message by round-robining across target
+// queues, so a single spammy target can't starve the others. A target
+// queue that is drained and has no enqueue in flight is evicted, so a
+// bot replying to many distinct nicks or channels over time doesn't
+// accumulate one queue per target forever.
+func (c *Client) dequeue() (*irc.Message, bool) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	for i := 0; i < len(c.order); i++ {
+		idx := (c.sched + i) % len(c.order)
+		key := c.order[idx]
+		q := c.targets[key]
+		select {
+		case m := <-q:
+			c.sched = idx + 1
+			if len(q) == 0 && c.pending[key] == 0 {
+				c.order = append(c.order[:idx], c.order[idx+1:]...)
+				delete(c.targets, key)
+				delete(c.pending, key)
+				if c.sched > idx {
+					c.sched--
+				}
+			}
+			return m, true
+		default:
+		}
+	}
+	return nil, false
+}
+
+// next blocks until there is a message to send, a priority message
+// always winning over queued ones, and queued ones waiting for a rate
+// limit token (if one is configured) before being returned. A queued
+// message that is already popped but still waiting on a token does not
+// block a priority message behind it: it's pushed back onto priority,
+// behind any priority messages already waiting, and goes out from
+// there without waiting for a token.
+func (c *Client) next(s *session) (*irc.Message, bool) {
+	for {
+		select {
+		case <-s.quit:
+			return nil, false
+		case m := <-c.priority:
+			return m, true
+		default:
+		}
+
+		m, ok := c.dequeue()
+		if !ok {
+			select {
+			case <-s.quit:
+				return nil, false
+			case m := <-c.priority:
+				return m, true
+			case <-c.ready:
+			}
+			continue
+		}
+
+		c.sendMu.Lock()
+		tokens := c.tokens
+		c.sendMu.Unlock()
+		if tokens == nil {
+			return m, true
+		}
+
+		select {
+		case <-tokens:
+			return m, true
+		case <-s.quit:
+			return nil, false
+		case p := <-c.priority:
+			c.priority <- m
+			return p, true
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package bot
+
+import (
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+// newTestClient returns a Client with its send queues initialized but
+// no connection, suitable for exercising enqueue/dequeue directly.
+func newTestClient() *Client {
+	c := new(Client)
+	c.initQueues()
+	return c
+}
+
+func TestDequeueRoundRobinsAcrossTargets(t *testing.T) {
+	c := newTestClient()
+
+	c.enqueue(&irc.Message{Command: irc.PRIVMSG, Params: []string{"alice"}, Trailing: "1"})
+	c.enqueue(&irc.Message{Command: irc.PRIVMSG, Params: []string{"bob"}, Trailing: "1"})
+	c.enqueue(&irc.Message{Command: irc.PRIVMSG, Params: []string{"alice"}, Trailing: "2"})
+	c.enqueue(&irc.Message{Command: irc.PRIVMSG, Params: []string{"bob"}, Trailing: "2"})
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		m, ok := c.dequeue()
+		if !ok {
+			t.Fatalf("dequeue %d: expected a message, got none", i)
+		}
+		got = append(got, m.Params[0]+":"+m.Trailing)
+	}
+
+	want := []string{"alice:1", "bob:1", "alice:2", "bob:2"}
+	for i, w := range want {
+		if got[i] != w {
+			t.Errorf("message %d = %q, want %q (full order: %v)", i, got[i], w, got)
+		}
+	}
+}
+
+func TestDequeueEvictsDrainedTargets(t *testing.T) {
+	c := newTestClient()
+
+	c.enqueue(&irc.Message{Command: irc.PRIVMSG, Params: []string{"alice"}, Trailing: "hi"})
+	if _, ok := c.dequeue(); !ok {
+		t.Fatal("dequeue: expected a message")
+	}
+
+	if _, ok := c.targets["alice"]; ok {
+		t.Error("alice's queue was not evicted after being drained")
+	}
+	if len(c.order) != 0 {
+		t.Errorf("c.order = %v, want empty after eviction", c.order)
+	}
+
+	if m, ok := c.dequeue(); ok {
+		t.Errorf("dequeue on empty queues returned %v, want (nil, false)", m)
+	}
+
+	// A queue that was evicted must be recreated cleanly on the next
+	// enqueue for the same target, not reuse stale state.
+	c.enqueue(&irc.Message{Command: irc.PRIVMSG, Params: []string{"alice"}, Trailing: "again"})
+	m, ok := c.dequeue()
+	if !ok || m.Trailing != "again" {
+		t.Errorf("dequeue after re-enqueue = %v, %v, want \"again\", true", m, ok)
+	}
+}
+
+func TestDequeueNoTargetSharesEmptyKey(t *testing.T) {
+	c := newTestClient()
+
+	c.enqueue(&irc.Message{Command: irc.PING, Trailing: "1"})
+	c.enqueue(&irc.Message{Command: irc.PING, Trailing: "2"})
+
+	for i, want := range []string{"1", "2"} {
+		m, ok := c.dequeue()
+		if !ok || m.Trailing != want {
+			t.Errorf("message %d = %v, %v, want %q, true", i, m, ok, want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package bot
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+const ctcpDelim = "\x01"
+
+// Event wraps an incoming irc.Message with the sender's nick, user and
+// host split out of its Prefix for convenience.
+type Event struct {
+	*irc.Message
+	Nick, User, Host string
+}
+
+// newEvent builds an Event from a raw message.
+func newEvent(m *irc.Message) *Event {
+	e := &Event{Message: m}
+	if m.Prefix != nil {
+		e.Nick = m.Prefix.Name
+		e.User = m.Prefix.User
+		e.Host = m.Prefix.Host
+	}
+	return e
+}
+
+// Callback is a function registered with Router.AddCallback.
+type Callback func(*Event, irc.Sender)
+
+// Router dispatches incoming messages to callbacks registered per IRC
+// command or numeric, instead of forcing callers to write one big
+// switch over every message. A zero-value Router is not usable; create
+// one with NewRouter.
+//
+// Router implements the handler signature expected by NewClient and
+// NewClientDialer through its Dispatch method:
+//
+//	r := bot.NewRouter()
+//	c := bot.NewClient(conn, r.Dispatch, 0, 0)
+type Router struct {
+	mu        sync.Mutex
+	callbacks map[string]map[int]Callback
+	ids       map[int]string
+	nextID    int
+}
+
+// NewRouter returns a Router with the built-in default handlers
+// registered: PING/PONG keepalive, CTCP VERSION/PING/TIME replies, and
+// picking an alternate nick on 433 (nickname in use).
+func NewRouter() *Router {
+	r := &Router{
+		callbacks: make(map[string]map[int]Callback),
+		ids:       make(map[int]string),
+	}
+	r.registerDefaults()
+	return r
+}
+
+// AddCallback registers fn to run whenever a message with the given
+// command or numeric arrives, in addition to any callbacks already
+// registered for it. It returns an ID that can be passed to
+// RemoveCallback.
+func (r *Router) AddCallback(cmd string, fn Callback) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.callbacks[cmd] == nil {
+		r.callbacks[cmd] = make(map[int]Callback)
+	}
+	r.nextID++
+	id := r.nextID
+	r.callbacks[cmd][id] = fn
+	r.ids[id] = cmd
+	return id
+}
+
+// RemoveCallback removes a single callback previously returned by
+// AddCallback. It is a no-op if id is unknown.
+func (r *Router) RemoveCallback(id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cmd, ok := r.ids[id]
+	if !ok {
+		return
+	}
+	delete(r.ids, id)
+	delete(r.callbacks[cmd], id)
+}
+
+// ClearCallbacks removes every callback registered for cmd, including
+// the built-in defaults.
+func (r *Router) ClearCallbacks(cmd string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id := range r.callbacks[cmd] {
+		delete(r.ids, id)
+	}
+	delete(r.callbacks, cmd)
+}
+
+// Dispatch runs every callback registered for m's command or numeric,
+// and is itself the handler func to pass to NewClient or
+// NewClientDialer. CTCP requests embedded in a PRIVMSG are unwrapped
+// and dispatched under "CTCP_<tag>", e.g. "CTCP_VERSION", instead of
+// under PRIVMSG.
+func (r *Router) Dispatch(m *irc.Message, s irc.Sender) {
+	e := newEvent(m)
+
+	if m.Command == irc.PRIVMSG && strings.HasPrefix(m.Trailing, ctcpDelim) {
+		r.dispatchCTCP(e, s)
+		return
+	}
+
+	r.run(m.Command, e, s)
+}
+
+func (r *Router) dispatchCTCP(e *Event, s irc.Sender) {
+	text := strings.Trim(e.Trailing, ctcpDelim)
+	tag := text
+	if i := strings.IndexByte(text, ' '); i >= 0 {
+		tag = text[:i]
+	}
+	r.run("CTCP_"+tag, e, s)
+}
+
+func (r *Router) run(cmd string, e *Event, s irc.Sender) {
+	r.mu.Lock()
+	fns := make([]Callback, 0, len(r.callbacks[cmd]))
+	for _, fn := range r.callbacks[cmd] {
+		fns = append(fns, fn)
+	}
+	r.mu.Unlock()
+
+	for _, fn := range fns {
+		fn(e, s)
+	}
+}
+
+// registerDefaults wires up the handlers every bot needs regardless of
+// what it is otherwise built to do.
+func (r *Router) registerDefaults() {
+	r.AddCallback(irc.PING, func(e *Event, s irc.Sender) {
+		s.Send(&irc.Message{
+			Command:  irc.PONG,
+			Trailing: e.Trailing,
+		})
+	})
+
+	r.AddCallback("CTCP_VERSION", func(e *Event, s irc.Sender) {
+		s.Send(&irc.Message{
+			Command:  irc.NOTICE,
+			Params:   []string{e.Nick},
+			Trailing: ctcpDelim + "VERSION sorcix/bot" + ctcpDelim,
+		})
+	})
+
+	r.AddCallback("CTCP_PING", func(e *Event, s irc.Sender) {
+		s.Send(&irc.Message{
+			Command:  irc.NOTICE,
+			Params:   []string{e.Nick},
+			Trailing: e.Trailing,
+		})
+	})
+
+	r.AddCallback("CTCP_TIME", func(e *Event, s irc.Sender) {
+		s.Send(&irc.Message{
+			Command:  irc.NOTICE,
+			Params:   []string{e.Nick},
+			Trailing: ctcpDelim + "TIME " + time.Now().Format(time.RFC1123Z) + ctcpDelim,
+		})
+	})
+
+	r.AddCallback("433", func(e *Event, s irc.Sender) {
+		if len(e.Params) == 0 {
+			return
+		}
+		s.Send(&irc.Message{
+			Command: irc.NICK,
+			Params:  []string{e.Params[len(e.Params)-1] + "_"},
+		})
+	})
+}
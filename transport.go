@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"net"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// Transport is the wire-level connection a Client reads messages from
+// and writes messages to. It exists so Client isn't tied to a raw TCP
+// *irc.Conn: NewIRCTransport adapts a net.Conn for classic IRC, and
+// DialWebSocket adapts a WebSocket connection for bouncers that speak
+// IRC-over-WebSocket.
+type Transport interface {
+	ReadMessage() (*irc.Message, error)
+	WriteMessage(*irc.Message) error
+	Close() error
+	SetReadDeadline(time.Time) error
+	SetWriteDeadline(time.Time) error
+}
+
+// ircTransport is the original transport: an *irc.Conn over a raw
+// net.Conn, used for plain and TLS TCP connections.
+type ircTransport struct {
+	conn *irc.Conn
+	raw  net.Conn
+}
+
+// NewIRCTransport adapts conn (as returned by net.Dial or tls.Dial)
+// into a Transport speaking the classic line-based IRC protocol.
+func NewIRCTransport(conn net.Conn) Transport {
+	return &ircTransport{conn: irc.NewConn(conn), raw: conn}
+}
+
+func (t *ircTransport) ReadMessage() (*irc.Message, error) {
+	return t.conn.Decoder.Decode()
+}
+
+func (t *ircTransport) WriteMessage(m *irc.Message) error {
+	return t.conn.Encoder.Encode(m)
+}
+
+func (t *ircTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *ircTransport) SetReadDeadline(tm time.Time) error {
+	return t.raw.SetReadDeadline(tm)
+}
+
+func (t *ircTransport) SetWriteDeadline(tm time.Time) error {
+	return t.raw.SetWriteDeadline(tm)
+}
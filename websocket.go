@@ -0,0 +1,57 @@
+package bot
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sorcix/irc"
+)
+
+// wsTransport adapts a WebSocket connection into a Transport, framing
+// each IRC line as a single text message. This is how bouncers such as
+// soju and ergo expose IRC over WebSocket.
+type wsTransport struct {
+	conn *websocket.Conn
+}
+
+// DialWebSocket connects to a WebSocket IRC endpoint and returns a
+// Transport suitable for NewClientDialer. tlsConfig and headers are
+// optional and may be nil.
+func DialWebSocket(url string, tlsConfig *tls.Config, headers http.Header) (Transport, error) {
+	dialer := websocket.Dialer{TLSClientConfig: tlsConfig}
+
+	conn, _, err := dialer.Dial(url, headers)
+	if err != nil {
+		return nil, err
+	}
+	return &wsTransport{conn: conn}, nil
+}
+
+func (t *wsTransport) ReadMessage() (*irc.Message, error) {
+	_, data, err := t.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return irc.ParseMessage(strings.TrimRight(string(data), "\r\n")), nil
+}
+
+func (t *wsTransport) WriteMessage(m *irc.Message) error {
+	line := strings.TrimRight(string(m.Bytes()), "\r\n")
+	line = strings.ToValidUTF8(line, "�")
+	return t.conn.WriteMessage(websocket.TextMessage, []byte(line))
+}
+
+func (t *wsTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *wsTransport) SetReadDeadline(tm time.Time) error {
+	return t.conn.SetReadDeadline(tm)
+}
+
+func (t *wsTransport) SetWriteDeadline(tm time.Time) error {
+	return t.conn.SetWriteDeadline(tm)
+}